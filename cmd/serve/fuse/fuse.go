@@ -0,0 +1,289 @@
+//go:build unix
+
+// Package fuse provides a FUSE server backed by a VFS, as an
+// alternative to the "serve nfsv3" command for platforms and
+// clients that would rather mount the remote directly. go-fuse, and
+// the syscall.Stat_t/S_IFDIR/S_IFREG constants this file uses to build
+// FUSE attributes, are unix-only, so this command isn't available on
+// Windows.
+package fuse
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rclone/rclone/cmd"
+	"github.com/rclone/rclone/vfs"
+	"github.com/rclone/rclone/vfs/vfsflags"
+	"github.com/spf13/cobra"
+)
+
+// Options required for the fuse server
+type Options struct {
+}
+
+// DefaultOpt is the default values used for Options
+var DefaultOpt = Options{}
+
+// Opt is options set by command line flags
+var Opt = DefaultOpt
+
+func init() {
+	vfsflags.AddFlags(Command.Flags())
+}
+
+// Command definition for cobra
+var Command = &cobra.Command{
+	Use:   "fuse remote:path /path/to/mountpoint",
+	Short: `Mount the remote as a FUSE filesystem.`,
+	Long: `Mount the remote as a FUSE filesystem using go-fuse, as a sibling
+to "serve nfsv3" for platforms that would rather mount the remote
+directly than set up an NFS client.
+` + vfs.Help,
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(2, 2, command, args)
+		f := cmd.NewFsSrc(args[:1])
+		mountpoint := args[1]
+		cmd.Run(false, true, command, func() error {
+			VFS := vfs.New(f, &vfsflags.Opt)
+			root := &fuseNode{vfs: VFS, path: ""}
+			server, err := fusefs.Mount(mountpoint, root, &fusefs.Options{
+				MountOptions: fuse.MountOptions{
+					FsName: f.Name(),
+					Name:   "rclone",
+				},
+			})
+			if err != nil {
+				return err
+			}
+			server.Wait()
+			return nil
+		})
+	},
+}
+
+// fuseNode is an fs.InodeEmbedder backed by a path inside a vfs.VFS
+type fuseNode struct {
+	fusefs.Inode
+	vfs  *vfs.VFS
+	path string
+}
+
+var (
+	_ fusefs.NodeLookuper  = (*fuseNode)(nil)
+	_ fusefs.NodeReaddirer = (*fuseNode)(nil)
+	_ fusefs.NodeOpener    = (*fuseNode)(nil)
+	_ fusefs.NodeCreater   = (*fuseNode)(nil)
+	_ fusefs.NodeMkdirer   = (*fuseNode)(nil)
+	_ fusefs.NodeRenamer   = (*fuseNode)(nil)
+	_ fusefs.NodeUnlinker  = (*fuseNode)(nil)
+	_ fusefs.NodeRmdirer   = (*fuseNode)(nil)
+	_ fusefs.NodeGetattrer = (*fuseNode)(nil)
+	_ fusefs.NodeSetattrer = (*fuseNode)(nil)
+)
+
+// child returns the VFS path for a name inside this node
+func (n *fuseNode) child(name string) string {
+	return filepath.Join(n.path, name)
+}
+
+// attrFromInfo fills out from a os.FileInfo returned by the VFS
+func attrFromInfo(info os.FileInfo, out *fuse.Attr) {
+	out.Mode = uint32(info.Mode().Perm())
+	if info.IsDir() {
+		out.Mode |= syscall.S_IFDIR
+	} else {
+		out.Mode |= syscall.S_IFREG
+	}
+	out.Size = uint64(info.Size())
+	mtime := info.ModTime()
+	out.SetTimes(&mtime, &mtime, &mtime)
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		out.Owner.Uid = st.Uid
+		out.Owner.Gid = st.Gid
+	}
+}
+
+// Lookup implements fusefs.NodeLookuper
+func (n *fuseNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	path := n.child(name)
+	info, err := n.vfs.Stat(path)
+	if err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	attrFromInfo(info, &out.Attr)
+	child := &fuseNode{vfs: n.vfs, path: path}
+	mode := uint32(syscall.S_IFREG)
+	if info.IsDir() {
+		mode = syscall.S_IFDIR
+	}
+	return n.NewInode(ctx, child, fusefs.StableAttr{Mode: mode}), fusefs.OK
+}
+
+// Readdir implements fusefs.NodeReaddirer
+func (n *fuseNode) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	infos, err := n.vfs.ReadDir(n.path)
+	if err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	entries := make([]fuse.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		mode := uint32(syscall.S_IFREG)
+		if info.IsDir() {
+			mode = syscall.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: info.Name(), Mode: mode})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return fusefs.NewListDirStream(entries), fusefs.OK
+}
+
+// Getattr implements fusefs.NodeGetattrer
+func (n *fuseNode) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	info, err := n.vfs.Stat(n.path)
+	if err != nil {
+		return fusefs.ToErrno(err)
+	}
+	attrFromInfo(info, &out.Attr)
+	return fusefs.OK
+}
+
+// Setattr implements fusefs.NodeSetattrer, handling truncation from ftruncate/truncate
+func (n *fuseNode) Setattr(ctx context.Context, f fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		handle, err := n.vfs.OpenFile(n.path, os.O_WRONLY, 0644)
+		if err != nil {
+			return fusefs.ToErrno(err)
+		}
+		err = handle.Truncate(int64(size))
+		closeErr := handle.Close()
+		if err != nil {
+			return fusefs.ToErrno(err)
+		}
+		if closeErr != nil {
+			return fusefs.ToErrno(closeErr)
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+// Open implements fusefs.NodeOpener
+func (n *fuseNode) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	handle, err := n.vfs.OpenFile(n.path, int(flags), 0644)
+	if err != nil {
+		return nil, 0, fusefs.ToErrno(err)
+	}
+	return &fuseFileHandle{handle: handle}, 0, fusefs.OK
+}
+
+// Create implements fusefs.NodeCreater
+func (n *fuseNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	path := n.child(name)
+	handle, err := n.vfs.OpenFile(path, int(flags)|os.O_CREATE, os.FileMode(mode))
+	if err != nil {
+		return nil, nil, 0, fusefs.ToErrno(err)
+	}
+	info, err := n.vfs.Stat(path)
+	if err != nil {
+		return nil, nil, 0, fusefs.ToErrno(err)
+	}
+	attrFromInfo(info, &out.Attr)
+	child := &fuseNode{vfs: n.vfs, path: path}
+	inode := n.NewInode(ctx, child, fusefs.StableAttr{Mode: syscall.S_IFREG})
+	return inode, &fuseFileHandle{handle: handle}, 0, fusefs.OK
+}
+
+// Mkdir implements fusefs.NodeMkdirer
+func (n *fuseNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	path := n.child(name)
+	if err := n.vfs.Mkdir(path, os.FileMode(mode)); err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	info, err := n.vfs.Stat(path)
+	if err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	attrFromInfo(info, &out.Attr)
+	child := &fuseNode{vfs: n.vfs, path: path}
+	return n.NewInode(ctx, child, fusefs.StableAttr{Mode: syscall.S_IFDIR}), fusefs.OK
+}
+
+// Rename implements fusefs.NodeRenamer
+func (n *fuseNode) Rename(ctx context.Context, name string, newParent fusefs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	newDir, ok := newParent.(*fuseNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	err := n.vfs.Rename(n.child(name), newDir.child(newName))
+	return fusefs.ToErrno(err)
+}
+
+// Unlink implements fusefs.NodeUnlinker
+func (n *fuseNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return fusefs.ToErrno(n.vfs.Remove(n.child(name)))
+}
+
+// Rmdir implements fusefs.NodeRmdirer
+func (n *fuseNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return fusefs.ToErrno(n.vfs.Remove(n.child(name)))
+}
+
+// fuseFileHandle adapts a vfs.Handle to the go-fuse file handle interfaces
+type fuseFileHandle struct {
+	handle vfs.Handle
+}
+
+var (
+	_ fusefs.FileReader   = (*fuseFileHandle)(nil)
+	_ fusefs.FileWriter   = (*fuseFileHandle)(nil)
+	_ fusefs.FileFsyncer  = (*fuseFileHandle)(nil)
+	_ fusefs.FileFlusher  = (*fuseFileHandle)(nil)
+	_ fusefs.FileReleaser = (*fuseFileHandle)(nil)
+)
+
+// Read implements fusefs.FileReader. It uses ReadAt rather than
+// Seek+Read because go-fuse dispatches requests against the same open
+// file concurrently: two in-flight calls sharing fh.handle's seek
+// cursor could otherwise interleave their Seek and Read and end up
+// reading at the wrong offset.
+func (fh *fuseFileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := fh.handle.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, fusefs.ToErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), fusefs.OK
+}
+
+// Write implements fusefs.FileWriter. See Read for why this uses
+// WriteAt rather than Seek+Write.
+func (fh *fuseFileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	n, err := fh.handle.WriteAt(data, off)
+	if err != nil {
+		return uint32(n), fusefs.ToErrno(err)
+	}
+	return uint32(n), fusefs.OK
+}
+
+// Fsync implements fusefs.FileFsyncer
+func (fh *fuseFileHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	if syncer, ok := fh.handle.(interface{ Sync() error }); ok {
+		return fusefs.ToErrno(syncer.Sync())
+	}
+	return fusefs.OK
+}
+
+// Flush implements fusefs.FileFlusher
+func (fh *fuseFileHandle) Flush(ctx context.Context) syscall.Errno {
+	return fusefs.OK
+}
+
+// Release implements fusefs.FileReleaser
+func (fh *fuseFileHandle) Release(ctx context.Context) syscall.Errno {
+	return fusefs.ToErrno(fh.handle.Close())
+}
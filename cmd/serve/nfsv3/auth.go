@@ -0,0 +1,150 @@
+package nfsv3
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+// Squash controls when the anon uid/gid is substituted for a resolved
+// uid/gid, mirroring the squash options of /etc/exports.
+type Squash string
+
+// Squash modes
+const (
+	SquashNone Squash = "none" // report the resolved uid/gid as is
+	SquashRoot Squash = "root" // map a resolved uid/gid of 0 to the anon uid/gid
+	SquashAll  Squash = "all"  // always report the anon uid/gid
+)
+
+// callerIdentity is the uid/gid asserted by an NFS client's AUTH_UNIX
+// (AUTH_SYS) credential, if it presented one on the MOUNT call.
+type callerIdentity struct {
+	uid, gid uint32
+	ok       bool
+}
+
+// resolvedOwner computes the uid/gid this server reports to NFS clients
+// for a connection, applying --nfs-squash to the identity the client
+// actually asserted (caller), the way root_squash/all_squash apply to
+// the caller's uid in /etc/exports - not to the server's own
+// configuration. --nfs-uid/--nfs-gid are only a fallback identity for
+// clients that mount with AUTH_NULL and assert no identity at all.
+//
+// uidSet/gidSet independently report whether uid/gid were actually
+// resolved to something this server should report, rather than passing
+// the real VFS owner through unchanged: --nfs-uid and --nfs-gid can be
+// set independently, so one being unset must not corrupt the other.
+func resolvedOwner(opt Options, caller callerIdentity) (uid, gid uint32, uidSet, gidSet bool) {
+	if caller.ok {
+		uid, gid, uidSet, gidSet = caller.uid, caller.gid, true, true
+	} else {
+		if opt.UID >= 0 {
+			uid, uidSet = uint32(opt.UID), true
+		}
+		if opt.GID >= 0 {
+			gid, gidSet = uint32(opt.GID), true
+		}
+	}
+
+	switch Squash(opt.Squash) {
+	case SquashAll:
+		uid, gid = uint32(opt.AnonUID), uint32(opt.AnonGID)
+		uidSet, gidSet = true, true
+	case SquashRoot:
+		if uidSet && uid == 0 {
+			uid = uint32(opt.AnonUID)
+		}
+		if gidSet && gid == 0 {
+			gid = uint32(opt.AnonGID)
+		}
+	}
+	return uid, gid, uidSet, gidSet
+}
+
+// authUnixIdentity extracts an AUTH_UNIX (AUTH_SYS) credential from
+// req, if the client presented one on the MOUNT call.
+//
+// The go-nfs Handler interface only ever hands credentials to us at
+// Mount time - ToHandle, FromHandle and the caching handler all take no
+// per-call identity - so the identity resolved here is used for every
+// subsequent call the client makes on this connection, not re-checked
+// per RPC.
+func authUnixIdentity(req nfs.MountRequest) callerIdentity {
+	cred, ok := req.Credential.(*nfs.AuthUnix)
+	if !ok || cred == nil {
+		return callerIdentity{}
+	}
+	return callerIdentity{uid: cred.UID, gid: cred.GID, ok: true}
+}
+
+// ownFileInfo wraps fi to report the resolved uid/gid from Sys(),
+// passing fi through unchanged if it is nil or neither uid nor gid was
+// resolved. The actual overlay is platform-specific, see
+// newOwnedFileInfo in owner_unix.go/owner_other.go.
+func ownFileInfo(fi os.FileInfo, uid, gid uint32, uidSet, gidSet bool) os.FileInfo {
+	if fi == nil || (!uidSet && !gidSet) {
+		return fi
+	}
+	return newOwnedFileInfo(fi, uid, gid, uidSet, gidSet)
+}
+
+// parseAllowlist turns the comma separated --nfs-allow value into
+// IPNets for checkAllowed. A bare IP is treated as a /32 (or /128 for
+// IPv6). An empty string allows every client.
+func parseAllowlist(csv string) ([]*net.IPNet, error) {
+	csv = strings.TrimSpace(csv)
+	if csv == "" {
+		return nil, nil
+	}
+	var allow []*net.IPNet
+	for _, entry := range strings.Split(csv, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid --nfs-allow entry %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --nfs-allow entry %q: %w", entry, err)
+		}
+		allow = append(allow, ipNet)
+	}
+	return allow, nil
+}
+
+// checkAllowed reports whether conn's remote address is permitted to
+// mount, per the --nfs-allow allowlist. A nil/empty allowlist allows
+// every client.
+func checkAllowed(conn net.Conn, allow []*net.IPNet) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package nfsv3
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	if allow, err := parseAllowlist(""); err != nil || allow != nil {
+		t.Fatalf("parseAllowlist(%q) = %v, %v, want nil, nil", "", allow, err)
+	}
+
+	allow, err := parseAllowlist("10.0.0.1, 192.168.0.0/24 ,::1")
+	if err != nil {
+		t.Fatalf("parseAllowlist: %v", err)
+	}
+	if len(allow) != 3 {
+		t.Fatalf("parseAllowlist returned %d entries, want 3", len(allow))
+	}
+	for _, test := range []struct {
+		ip    string
+		allow bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"192.168.0.5", true},
+		{"192.168.1.5", false},
+		{"::1", true},
+	} {
+		got := ipInAllowlist(t, allow, test.ip)
+		if got != test.allow {
+			t.Errorf("allow list for %s = %v, want %v", test.ip, got, test.allow)
+		}
+	}
+
+	if _, err := parseAllowlist("not-an-ip"); err == nil {
+		t.Fatalf("parseAllowlist(%q) did not return an error", "not-an-ip")
+	}
+}
+
+func ipInAllowlist(t *testing.T, allow []*net.IPNet, ip string) bool {
+	t.Helper()
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		t.Fatalf("invalid test IP %q", ip)
+	}
+	for _, n := range allow {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckAllowed(t *testing.T) {
+	allow, err := parseAllowlist("10.0.0.0/24")
+	if err != nil {
+		t.Fatalf("parseAllowlist: %v", err)
+	}
+
+	if !checkAllowed(fakeConn{"10.0.0.5:1234"}, nil) {
+		t.Errorf("an empty allowlist should allow every client")
+	}
+	if !checkAllowed(fakeConn{"10.0.0.5:1234"}, allow) {
+		t.Errorf("10.0.0.5 should be allowed by 10.0.0.0/24")
+	}
+	if checkAllowed(fakeConn{"10.0.1.5:1234"}, allow) {
+		t.Errorf("10.0.1.5 should not be allowed by 10.0.0.0/24")
+	}
+}
+
+// fakeConn is a minimal net.Conn stand-in: only RemoteAddr needs to do
+// anything real, which is all checkAllowed uses.
+type fakeConn struct {
+	remoteAddr string
+}
+
+func (fakeConn) Read(b []byte) (int, error)       { return 0, nil }
+func (fakeConn) Write(b []byte) (int, error)      { return 0, nil }
+func (fakeConn) Close() error                     { return nil }
+func (fakeConn) LocalAddr() net.Addr              { return nil }
+func (f fakeConn) RemoteAddr() net.Addr           { return fakeAddr(f.remoteAddr) }
+func (fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type fakeAddr string
+
+func (fakeAddr) Network() string  { return "tcp" }
+func (a fakeAddr) String() string { return string(a) }
+
+func TestAuthUnixIdentity(t *testing.T) {
+	req := nfs.MountRequest{Credential: &nfs.AuthUnix{UID: 1000, GID: 1000}}
+	caller := authUnixIdentity(req)
+	if !caller.ok || caller.uid != 1000 || caller.gid != 1000 {
+		t.Fatalf("authUnixIdentity for an AUTH_UNIX credential = %+v, want uid=1000, gid=1000, ok=true", caller)
+	}
+
+	// AUTH_NULL presents no credential at all.
+	if caller := authUnixIdentity(nfs.MountRequest{}); caller.ok {
+		t.Fatalf("authUnixIdentity with no credential = %+v, want ok=false", caller)
+	}
+}
+
+func TestResolvedOwner(t *testing.T) {
+	base := Options{UID: -1, GID: -1, AnonUID: 65534, AnonGID: 65534, Squash: string(SquashRoot)}
+
+	// No caller identity and nothing configured: pass the VFS owner
+	// through unchanged.
+	uid, gid, uidSet, gidSet := resolvedOwner(base, callerIdentity{})
+	if uidSet || gidSet {
+		t.Fatalf("resolvedOwner with nothing configured and no caller = %d, %d, %v, %v, want unset", uid, gid, uidSet, gidSet)
+	}
+
+	// A non-root caller is passed through even under root squash.
+	uid, gid, uidSet, gidSet = resolvedOwner(base, callerIdentity{uid: 1000, gid: 1000, ok: true})
+	if !uidSet || !gidSet || uid != 1000 || gid != 1000 {
+		t.Fatalf("resolvedOwner for a non-root caller = %d, %d, %v, %v, want 1000, 1000, true, true", uid, gid, uidSet, gidSet)
+	}
+
+	// A root caller is squashed to the anon uid/gid under SquashRoot.
+	uid, gid, uidSet, gidSet = resolvedOwner(base, callerIdentity{uid: 0, gid: 0, ok: true})
+	if !uidSet || !gidSet || uid != 65534 || gid != 65534 {
+		t.Fatalf("resolvedOwner for a root caller under SquashRoot = %d, %d, %v, %v, want 65534, 65534, true, true", uid, gid, uidSet, gidSet)
+	}
+
+	// SquashAll always reports the anon uid/gid, even for a non-root caller.
+	all := base
+	all.Squash = string(SquashAll)
+	uid, gid, uidSet, gidSet = resolvedOwner(all, callerIdentity{uid: 1000, gid: 1000, ok: true})
+	if !uidSet || !gidSet || uid != 65534 || gid != 65534 {
+		t.Fatalf("resolvedOwner under SquashAll = %d, %d, %v, %v, want 65534, 65534, true, true", uid, gid, uidSet, gidSet)
+	}
+
+	// With no caller identity (AUTH_NULL), --nfs-uid and --nfs-gid are
+	// independent fallbacks: setting one must not corrupt the other.
+	uidOnly := base
+	uidOnly.UID = 42
+	uid, gid, uidSet, gidSet = resolvedOwner(uidOnly, callerIdentity{})
+	if !uidSet || uid != 42 {
+		t.Fatalf("resolvedOwner with only --nfs-uid set: uid = %d, uidSet = %v, want 42, true", uid, uidSet)
+	}
+	if gidSet {
+		t.Fatalf("resolvedOwner with only --nfs-uid set left gidSet = true, gid = %d, want gidSet = false", gid)
+	}
+}
@@ -2,71 +2,173 @@
 package nfsv3
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	iofs "io/fs"
 	"math"
+	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	billy "github.com/go-git/go-billy/v5"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/rclone/rclone/cmd"
 	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
 	"github.com/rclone/rclone/vfs"
 	"github.com/rclone/rclone/vfs/vfsflags"
 	"github.com/spf13/cobra"
 	nfs "github.com/willscott/go-nfs"
+	bolt "go.etcd.io/bbolt"
 )
 
 const separator = filepath.Separator
 
 // Options required for nfsv3 server
 type Options struct {
+	HandleCacheSize int    // number of file handles to keep in the in-memory LRU
+	HandleCacheDir  string // directory to persist file handles in, "" to disable
+
+	UID     int    // uid reported to clients that assert no AUTH_UNIX identity, -1 to pass through the VFS owner
+	GID     int    // gid reported to clients that assert no AUTH_UNIX identity, -1 to pass through the VFS owner
+	AnonUID int    // uid substituted for the resolved uid when squashed
+	AnonGID int    // gid substituted for the resolved gid when squashed
+	Squash  string // one of "none", "root" or "all"
+	Allow   string // comma separated list of CIDRs allowed to mount, empty allows all
+
+	Addr    string // interface to bind to, "" for all interfaces
+	Port    int    // port to listen on
+	Network string // tcp, tcp4 or tcp6 (udp is not supported by the underlying NFS library)
+	Portmap bool   // register the chosen port with the local rpcbind daemon
 }
 
 // DefaultOpt is the default values used for Options
-var DefaultOpt = Options{}
+var DefaultOpt = Options{
+	HandleCacheSize: MAX_FILE_HANDLES,
+	HandleCacheDir:  filepath.Join(config.CacheDir, "nfs"),
+	UID:             -1,
+	GID:             -1,
+	AnonUID:         65534,
+	AnonGID:         65534,
+	Squash:          string(SquashRoot),
+	Port:            2049,
+	Network:         "tcp4",
+}
 
 // Opt is options set by command line flags
 var Opt = DefaultOpt
 
 func init() {
 	vfsflags.AddFlags(Command.Flags())
+	flags := Command.Flags()
+	flags.IntVar(&Opt.HandleCacheSize, "nfs-handle-cache-size", Opt.HandleCacheSize, "Number of file handles to cache in memory")
+	flags.StringVar(&Opt.HandleCacheDir, "nfs-handle-cache-dir", Opt.HandleCacheDir, "Directory to persist file handles across restarts, empty to disable")
+	flags.IntVar(&Opt.UID, "nfs-uid", Opt.UID, "UID to report for clients without AUTH_UNIX credentials, -1 to use the VFS owner")
+	flags.IntVar(&Opt.GID, "nfs-gid", Opt.GID, "GID to report for clients without AUTH_UNIX credentials, -1 to use the VFS owner")
+	flags.IntVar(&Opt.AnonUID, "nfs-anonuid", Opt.AnonUID, "UID substituted for the client's UID when squashed")
+	flags.IntVar(&Opt.AnonGID, "nfs-anongid", Opt.AnonGID, "GID substituted for the client's GID when squashed")
+	flags.StringVar(&Opt.Squash, "nfs-squash", Opt.Squash, "Squash mode: none, root or all")
+	flags.StringVar(&Opt.Allow, "nfs-allow", Opt.Allow, "Comma separated list of CIDRs allowed to mount, empty allows all")
+	flags.StringVar(&Opt.Addr, "nfs-addr", Opt.Addr, "IP address to bind to, empty for all interfaces")
+	flags.IntVar(&Opt.Port, "nfs-port", Opt.Port, "Port to listen on")
+	flags.StringVar(&Opt.Network, "nfs-network", Opt.Network, "Network to listen on: tcp, tcp4 or tcp6")
+	flags.BoolVar(&Opt.Portmap, "nfs-portmap", Opt.Portmap, "Register the listening port with the local rpcbind (portmap) daemon")
 }
 
 // Command definition for cobra
 var Command = &cobra.Command{
 	Use:   "nfsv3 remote:path",
 	Short: `Serve the remote over NFS v3.`,
-	Long: `Run a basic nfs v3 server to serve a remote over NFS version 3 (TCP).
+	Long: `Run a basic nfs v3 server to serve a remote over NFS version 3.
+
+Only TCP transports (tcp, tcp4, tcp6) are implemented for --nfs-network.
+UDP is not supported: some embedded NFS clients default to it, but
+adding it is left for future work, not delivered here.
 ` + vfs.Help,
 	Run: func(command *cobra.Command, args []string) {
 		cmd.CheckArgs(1, 1, command, args)
 		f := cmd.NewFsSrc(args)
 		cmd.Run(false, true, command, func() error {
-			listener, err := net.Listen("tcp4", ":2049")
+			listener, err := newListener(Opt)
 			if err != nil {
 				return err
 			}
 
+			if Opt.Portmap {
+				if _, portStr, err := net.SplitHostPort(listener.Addr().String()); err == nil {
+					if port, err := strconv.Atoi(portStr); err == nil {
+						if err := registerPortmap(port, Opt.Network); err != nil {
+							fs.Errorf(nil, "nfsv3: failed to register with rpcbind, continuing without it: %v", err)
+						} else {
+							defer func() { _ = unregisterPortmap(Opt.Network) }()
+						}
+					}
+				}
+			}
+
 			s := newServer(f)
 			return nfs.Serve(listener, s)
 		})
 	},
 }
 
+// newListener opens the listener the server accepts connections on:
+// a pre-opened systemd/launchd socket-activation fd if one was
+// handed to us, otherwise a fresh listener bound per opt.
+func newListener(opt Options) (net.Listener, error) {
+	if l, ok, err := activationListener(); ok {
+		return l, err
+	}
+	switch opt.Network {
+	case "tcp", "tcp4", "tcp6":
+		return net.Listen(opt.Network, net.JoinHostPort(opt.Addr, strconv.Itoa(opt.Port)))
+	default:
+		// NFS v3 over UDP isn't implemented by this server: it isn't
+		// just rejected here, --nfs-network doesn't advertise udp as
+		// an accepted value either (see the flag registration in init).
+		return nil, fmt.Errorf("nfsv3: unknown --nfs-network %q: only tcp, tcp4 and tcp6 are implemented", opt.Network)
+	}
+}
+
+// activationListener returns a listener built from a pre-opened fd
+// passed to us via systemd/launchd socket activation (LISTEN_PID and
+// LISTEN_FDS), so the server can run as an unprivileged user on port
+// 2049. ok is false when no activation socket was provided.
+func activationListener() (l net.Listener, ok bool, err error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, false, nil
+	}
+	// By convention the first passed fd is 3 (stdin, stdout, stderr precede it).
+	file := os.NewFile(uintptr(3), "nfsv3-activation-socket")
+	l, err = net.FileListener(file)
+	return l, true, err
+}
+
 type billyFs struct {
 	// billy.Filesystem
 	*vfs.VFS
+	uidSet, gidSet bool // whether uid/gid below should override the VFS owner
+	uid, gid       uint32
+	handles        *handleStore // used to purge handles for paths that are removed or renamed away
+	gen            *genCounter  // bumped on Remove/Rename so ToHandle/FromHandle can detect a path's identity changed
 }
 
 func (billyFs) Capabilities() billy.Capability {
-	// return billy.DefaultCapabilities & ^billy.LockCapability
-	return billy.ReadCapability | billy.SeekCapability
+	return billy.DefaultCapabilities
 }
 
 type billyFile struct {
@@ -92,11 +194,43 @@ func (fs billyFs) OpenFile(filename string, flag int, perm os.FileMode) (billy.F
 }
 
 func (fs billyFs) Remove(filename string) error {
-	return fs.VFS.Remove(filename)
+	err := fs.VFS.Remove(filename)
+	if err == nil {
+		path := splitPath(filename)
+		fs.gen.bump(path)
+		if fs.handles != nil {
+			_ = fs.handles.deleteByPath(path)
+		}
+	}
+	return err
 }
 
 func (fs billyFs) Rename(oldpath, newpath string) error {
-	return fs.VFS.Rename(oldpath, newpath)
+	err := fs.VFS.Rename(oldpath, newpath)
+	if err == nil {
+		// Bump and purge handles for both names: oldpath no longer
+		// exists, and any handle minted for newpath before the rename
+		// now points at stale content that the rename just overwrote.
+		old, new_ := splitPath(oldpath), splitPath(newpath)
+		fs.gen.bump(old)
+		fs.gen.bump(new_)
+		if fs.handles != nil {
+			_ = fs.handles.deleteByPath(old)
+			_ = fs.handles.deleteByPath(new_)
+		}
+	}
+	return err
+}
+
+// splitPath breaks a VFS path into the same component slice that
+// ToHandle/FromHandle key file handles by (see pathHash), so Remove and
+// Rename can purge exactly the handles that were minted for a path.
+func splitPath(path string) []string {
+	path = strings.Trim(filepath.Clean(path), string(separator))
+	if path == "" || path == "." {
+		return nil
+	}
+	return strings.Split(path, string(separator))
 }
 
 /*
@@ -112,7 +246,9 @@ func (fi fileInfo) Name() string {
 
 func (fs billyFs) Stat(filename string) (fi os.FileInfo, err error) {
 	fi, err = fs.VFS.Stat(filename)
-	fmt.Printf("Stat: %v  %T: %+v\n", filename, fi, fi.Name())
+	if err == nil {
+		fi = ownFileInfo(fi, fs.uid, fs.gid, fs.uidSet, fs.gidSet)
+	}
 	return fi, err
 }
 
@@ -123,17 +259,53 @@ func (fs billyFs) Join(elem ...string) string {
 	return filepath.Join(elem...)
 }
 
+// fileLocks is an in-process advisory-lock table keyed by the path of
+// the underlying handle. It only coordinates clients of this one NFS
+// server process; it is not a substitute for a real cluster-wide lock
+// manager.
+var (
+	fileLocksMu sync.Mutex
+	fileLocks   = map[string]bool{}
+)
+
 func (f billyFile) Lock() error {
-	return billy.ErrNotSupported
+	fileLocksMu.Lock()
+	defer fileLocksMu.Unlock()
+	name := f.Handle.Name()
+	if fileLocks[name] {
+		return fmt.Errorf("nfsv3: %s is already locked", name)
+	}
+	fileLocks[name] = true
+	return nil
 }
 
 func (f billyFile) Unlock() error {
-	return billy.ErrNotSupported
+	fileLocksMu.Lock()
+	defer fileLocksMu.Unlock()
+	delete(fileLocks, f.Handle.Name())
+	return nil
+}
+
+// Close releases any lock a client took on this handle and never
+// released before closing it - e.g. a client that crashed or
+// disconnected without calling Unlock - so a wedged lock doesn't block
+// that path forever, then delegates to the underlying vfs.Handle.
+func (f billyFile) Close() error {
+	fileLocksMu.Lock()
+	delete(fileLocks, f.Handle.Name())
+	fileLocksMu.Unlock()
+	return f.Handle.Close()
 }
 
 // billy.Dir
 func (fs billyFs) ReadDir(path string) (fis []os.FileInfo, err error) {
-	return fs.VFS.ReadDir(path)
+	fis, err = fs.VFS.ReadDir(path)
+	if err == nil {
+		for i, fi := range fis {
+			fis[i] = ownFileInfo(fi, fs.uid, fs.gid, fs.uidSet, fs.gidSet)
+		}
+	}
+	return fis, err
 	/*
 		// fmt.Printf("Dir: %+v (%+v)\n", path, err)
 		for i, fi := range fis {
@@ -146,8 +318,23 @@ func (fs billyFs) ReadDir(path string) (fis []os.FileInfo, err error) {
 	*/
 }
 
+// MkdirAll creates filename and every missing parent directory, like
+// os.MkdirAll. It's implemented in terms of the single-level
+// vfs.VFS.Mkdir, the same call the sibling fuse command uses.
 func (fs billyFs) MkdirAll(filename string, perm os.FileMode) error {
-	return billy.ErrNotSupported
+	path := splitPath(filename)
+	if len(path) == 0 {
+		return nil
+	}
+	for i := range path {
+		dir := strings.Join(path[:i+1], string(separator))
+		err := fs.VFS.Mkdir(dir, perm)
+		if err == nil || errors.Is(err, iofs.ErrExist) {
+			continue
+		}
+		return err
+	}
+	return nil
 }
 
 // billy.Chroot
@@ -161,20 +348,37 @@ func (fs billyFs) Root() string {
 
 // billy.Symlink
 func (fs billyFs) Lstat(filename string) (os.FileInfo, error) {
-	return nil, billy.ErrNotSupported
+	fi, err := fs.VFS.Lstat(filename)
+	if err == nil {
+		fi = ownFileInfo(fi, fs.uid, fs.gid, fs.uidSet, fs.gidSet)
+	}
+	return fi, err
 }
 
 func (fs billyFs) Symlink(target, link string) error {
-	return billy.ErrNotSupported
+	return fs.VFS.Symlink(target, link)
 }
 
 func (fs billyFs) Readlink(link string) (string, error) {
-	return "", billy.ErrNotSupported
+	return fs.VFS.Readlink(link)
 }
 
 // billy.Tempfile
 func (fs billyFs) TempFile(dir, prefix string) (billy.File, error) {
-	return nil, billy.ErrNotSupported
+	if dir == "" {
+		dir = "/"
+	}
+	for i := 0; i < 10; i++ {
+		name := fs.Join(dir, fmt.Sprintf("%s%d", prefix, rand.Int63()))
+		handle, err := fs.VFS.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return billyFile{handle}, nil
+		}
+		if !errors.Is(err, iofs.ErrExist) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("nfsv3: failed to create temp file in %q after 10 attempts", dir)
 }
 
 type FileInfos []iofs.FileInfo
@@ -186,6 +390,53 @@ type VerifierPathPair struct {
 
 const MAX_FILE_HANDLES = 1024
 
+// A fileHandle is a stable, fixed-width NFS file handle: a hash of the
+// path components followed by the path's generation counter (see
+// genCounter) at the time the handle was minted, so that a later
+// rename/delete+recreate of the path the handle pointed at is detected
+// rather than silently resolved against whatever now lives at the old
+// hash.
+const (
+	handleHashSize    = sha256.Size
+	handleVersionSize = 8
+	handleSize        = handleHashSize + handleVersionSize
+)
+
+type fileHandle [handleSize]byte
+
+// genCounter tracks a per-path generation counter, keyed by pathHash.
+// It starts at 0 for every path and is only bumped by billyFs.Remove
+// and billyFs.Rename, not by ordinary writes - unlike the file's mtime,
+// which changes on every write and so can't distinguish "this handle's
+// file was edited" from "this handle's file is gone".
+//
+// The counter is process-local and starts from zero again after a
+// restart, so a persisted handle minted at a non-zero generation no
+// longer matches and is treated as expired, even if its path still
+// exists. Handles for a path that was renamed/removed away are purged
+// from the persistent store by billyFs.Remove/Rename (see
+// handleStore.deleteByPath), so they don't resolve after a restart.
+type genCounter struct {
+	mu  sync.Mutex
+	gen map[string]uint64
+}
+
+func newGenCounter() *genCounter {
+	return &genCounter{gen: make(map[string]uint64)}
+}
+
+func (g *genCounter) get(path []string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.gen[string(pathHash(path))]
+}
+
+func (g *genCounter) bump(path []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.gen[string(pathHash(path))]++
+}
+
 // server contains everything to run the server
 type server struct {
 	// handler        nfs.Handler
@@ -193,10 +444,25 @@ type server struct {
 	fs                  billyFs
 	pathForHandle       *lru.TwoQueueCache
 	contentsForVerifier *lru.TwoQueueCache
-}
-
-func (s *server) Mount(context.Context, net.Conn, nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
-	return nfs.MountStatusOk, s.fs, []nfs.AuthFlavor{nfs.AuthFlavorNull}
+	handleCacheSize     int
+	handleStore         *handleStore
+	allow               []*net.IPNet
+	opt                 Options
+	gen                 *genCounter // same counter as fs.gen, used by ToHandle/FromHandle
+}
+
+// Mount implements nfs.Handler. It enforces the --nfs-allow allowlist
+// and advertises AUTH_NULL and AUTH_UNIX (AUTH_SYS) to clients, then
+// resolves the uid/gid this connection's billy.Filesystem reports for
+// every file from whatever identity the client asserted, see
+// resolvedOwner and authUnixIdentity.
+func (s *server) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	if !checkAllowed(conn, s.allow) {
+		return nfs.MountStatusErrAccess, nil, nil
+	}
+	connFs := s.fs
+	connFs.uid, connFs.gid, connFs.uidSet, connFs.gidSet = resolvedOwner(s.opt, authUnixIdentity(req))
+	return nfs.MountStatusOk, connFs, []nfs.AuthFlavor{nfs.AuthFlavorNull, nfs.AuthFlavorUnix}
 }
 
 func (s *server) Change(fs billy.Filesystem) billy.Change {
@@ -217,37 +483,95 @@ func (s *server) FSStat(ctx context.Context, fs billy.Filesystem, fsStat *nfs.FS
 	return nil
 }
 
-func (s *server) ToHandle(fs billy.Filesystem, path []string) []byte {
-	// up to 64bytes
+// pathHash is the stable, version-independent part of a fileHandle:
+// the sha256 of the path components, each followed by a NUL delimiter
+// so that e.g. ["foo", "bar"] and ["foob", "ar"] don't hash identically.
+// It doubles as the lookup prefix handleStore.deleteByPath uses to find
+// every handle ever minted for a path.
+func pathHash(path []string) []byte {
 	vHash := sha256.New()
-
 	for _, item := range path {
 		vHash.Write([]byte(item))
+		vHash.Write([]byte{0})
 	}
-	sum := vHash.Sum(nil)
+	return vHash.Sum(nil)
+}
+
+func (s *server) ToHandle(fs billy.Filesystem, path []string) []byte {
+	sum := pathHash(path)
+	version := s.gen.get(path)
+
+	var key fileHandle
+	copy(key[:handleHashSize], sum)
+	binary.BigEndian.PutUint64(key[handleHashSize:], version)
 
-	var key [32]byte
-	copy(key[:], sum)
 	s.pathForHandle.Add(key, path)
-	return sum
+	if s.handleStore != nil {
+		_ = s.handleStore.put(key, path)
+	}
+	return key[:]
 }
 
 func (s *server) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
-	var key [32]byte
+	if len(fh) != handleSize {
+		return s.fs, nil, errors.New("invalid handle length")
+	}
+	var key fileHandle
 	copy(key[:], fh)
+
+	path, ok := s.lookupHandle(key)
+	if !ok {
+		return s.fs, nil, errors.New("handle unknown or expired")
+	}
+
+	// The handle is only valid for the exact file it was minted for:
+	// compare the path's current generation counter against the version
+	// baked into the handle, so a rename (or delete+recreate) at the
+	// same path invalidates the old handle instead of quietly resolving
+	// to whatever now lives there. An ordinary write doesn't bump the
+	// counter, so a handle stays valid across a read-modify-write of the
+	// same file.
+	wantVersion := binary.BigEndian.Uint64(key[handleHashSize:])
+	if s.gen.get(path) != wantVersion {
+		s.forgetHandle(key, path)
+		return s.fs, nil, errors.New("handle unknown or expired")
+	}
+
+	return s.fs, path, nil
+}
+
+// lookupHandle finds the path for a handle in the in-memory LRU,
+// falling back to and re-hydrating from the persistent store on a
+// miss.
+func (s *server) lookupHandle(key fileHandle) ([]string, bool) {
 	if value, ok := s.pathForHandle.Get(key); ok {
-		if path, ok := value.([]string); ok {
-			return s.fs, path, nil
-		} else {
-			return s.fs, nil, errors.New("invalid value in map")
-		}
+		path, ok := value.([]string)
+		return path, ok
+	}
+	if s.handleStore == nil {
+		return nil, false
+	}
+	path, ok := s.handleStore.get(key)
+	if !ok {
+		return nil, false
 	}
+	s.pathForHandle.Add(key, path)
+	return path, true
+}
 
-	return s.fs, nil, errors.New("handle unknown or expired")
+// forgetHandle drops a stale or invalidated handle from both the
+// in-memory LRU and the persistent store, including every other
+// handle still pointing at the same path, so a rename doesn't leave
+// the old handle's entry sitting in handles.db forever.
+func (s *server) forgetHandle(key fileHandle, path []string) {
+	s.pathForHandle.Remove(key)
+	if s.handleStore != nil {
+		s.handleStore.deleteByPath(path)
+	}
 }
 
 func (s *server) HandleLimit() int {
-	return MAX_FILE_HANDLES
+	return s.handleCacheSize
 }
 
 func (s *server) VerifierFor(path string, contents []iofs.FileInfo) uint64 {
@@ -274,12 +598,99 @@ func (s *server) DataForVerifier(path string, verifier uint64) []iofs.FileInfo {
 	return nil
 }
 
-func newServer(fs fs.Fs) *server {
-	vfs := vfs.New(fs, &vfsflags.Opt)
+// handleBucket is the bbolt bucket file handles are persisted under.
+var handleBucket = []byte("handles")
 
-	billyFs := billyFs{vfs}
-	handleCache, _ := lru.New2Q(MAX_FILE_HANDLES)
+// handleStore persists (handle, path) pairs to a bbolt database on
+// disk, so that NFS file handles survive a server restart instead of
+// all of a client's open handles going stale at once.
+type handleStore struct {
+	db *bolt.DB
+}
+
+func newHandleStore(dir string) (*handleStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create nfs handle cache dir: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "handles.db"), 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nfs handle cache: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(handleBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &handleStore{db: db}, nil
+}
+
+func (h *handleStore) put(key fileHandle, path []string) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(path); err != nil {
+		return err
+	}
+	return h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(handleBucket).Put(key[:], buf.Bytes())
+	})
+}
+
+// deleteByPath removes every handle minted for path, regardless of
+// which version (generation) they were minted with. It is called whenever
+// billyFs removes or renames a path, so handles.db doesn't grow
+// without bound as files churn over the life of the mount.
+func (h *handleStore) deleteByPath(path []string) error {
+	prefix := pathHash(path)
+	return h.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(handleBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (h *handleStore) get(key fileHandle) ([]string, bool) {
+	var path []string
+	err := h.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(handleBucket).Get(key[:])
+		if data == nil {
+			return errors.New("not found")
+		}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(&path)
+	})
+	if err != nil {
+		return nil, false
+	}
+	return path, true
+}
+
+func newServer(f fs.Fs) *server {
+	theVfs := vfs.New(f, &vfsflags.Opt)
+
+	handleCache, _ := lru.New2Q(Opt.HandleCacheSize)
 	verifierCache, _ := lru.New2Q(MAX_FILE_HANDLES)
-	s := &server{billyFs, handleCache, verifierCache}
+	store, err := newHandleStore(Opt.HandleCacheDir)
+	if err != nil {
+		fs.Errorf(nil, "nfsv3: disabling persistent handle cache: %v", err)
+	}
+	gen := newGenCounter()
+	// uid/gid are resolved per connection in Mount, from whatever
+	// identity the client asserts; billyFs here is just the template
+	// Mount copies for each connection.
+	billyFs := billyFs{VFS: theVfs, handles: store, gen: gen}
+	allow, err := parseAllowlist(Opt.Allow)
+	if err != nil {
+		fs.Errorf(nil, "nfsv3: %v, ignoring --nfs-allow", err)
+		allow = nil
+	}
+	s := &server{billyFs, handleCache, verifierCache, Opt.HandleCacheSize, store, allow, Opt, gen}
 	return s
 }
@@ -0,0 +1,176 @@
+package nfsv3
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathHashStable(t *testing.T) {
+	a := pathHash([]string{"foo", "bar"})
+	b := pathHash([]string{"foo", "bar"})
+	if string(a) != string(b) {
+		t.Fatalf("pathHash is not stable for the same path: %x != %x", a, b)
+	}
+	c := pathHash([]string{"foo", "baz"})
+	if string(a) == string(c) {
+		t.Fatalf("pathHash collided for different paths")
+	}
+	if len(a) != handleHashSize {
+		t.Fatalf("pathHash returned %d bytes, want %d", len(a), handleHashSize)
+	}
+}
+
+func TestPathHashDelimited(t *testing.T) {
+	// Without a delimiter between components, ["foo", "bar"] and
+	// ["foob", "ar"] would hash identically.
+	a := pathHash([]string{"foo", "bar"})
+	b := pathHash([]string{"foob", "ar"})
+	if string(a) == string(b) {
+		t.Fatalf("pathHash collided for [foo bar] and [foob ar]: components aren't delimited")
+	}
+}
+
+func TestGenCounter(t *testing.T) {
+	g := newGenCounter()
+	path := []string{"foo", "bar"}
+
+	if v := g.get(path); v != 0 {
+		t.Fatalf("get on a never-bumped path = %d, want 0", v)
+	}
+
+	g.bump(path)
+	if v := g.get(path); v != 1 {
+		t.Fatalf("get after one bump = %d, want 1", v)
+	}
+
+	// An unrelated path isn't affected by a bump.
+	other := []string{"foo", "baz"}
+	if v := g.get(other); v != 0 {
+		t.Fatalf("get on an unrelated path after bumping %v = %d, want 0", path, v)
+	}
+}
+
+// TestHandleVersionSurvivesWriteNotBump exercises the scenario that broke
+// with the old mtime-based version: mint a handle for a path (i.e.
+// read its generation), then confirm an ordinary write - which never
+// touches genCounter - leaves that generation unchanged, while a
+// rename or remove (which calls bump) does change it, so only the
+// latter invalidates a previously minted handle.
+func TestHandleVersionSurvivesWriteNotBump(t *testing.T) {
+	g := newGenCounter()
+	path := []string{"foo", "bar"}
+
+	mintedVersion := g.get(path)
+
+	// An ordinary write doesn't touch genCounter at all, so the version
+	// observed by a later FromHandle is unchanged.
+	if v := g.get(path); v != mintedVersion {
+		t.Fatalf("version changed across a simulated write: %d != %d", v, mintedVersion)
+	}
+
+	// A rename (or remove) bumps the counter, invalidating the old handle.
+	g.bump(path)
+	if v := g.get(path); v == mintedVersion {
+		t.Fatalf("version unchanged after bump (simulated rename/remove)")
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		want []string
+	}{
+		{"", nil},
+		{"/", nil},
+		{".", nil},
+		{"foo", []string{"foo"}},
+		{"/foo/bar", []string{"foo", "bar"}},
+		{"foo/bar/", []string{"foo", "bar"}},
+	} {
+		got := splitPath(test.path)
+		if len(got) != len(test.want) {
+			t.Fatalf("splitPath(%q) = %v, want %v", test.path, got, test.want)
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Fatalf("splitPath(%q) = %v, want %v", test.path, got, test.want)
+			}
+		}
+	}
+}
+
+func TestHandleStorePutGet(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newHandleStore(dir)
+	if err != nil {
+		t.Fatalf("newHandleStore: %v", err)
+	}
+	if store == nil {
+		t.Fatalf("newHandleStore(%q) returned a nil store", dir)
+	}
+	defer func() { _ = store.db.Close() }()
+
+	path := []string{"foo", "bar"}
+	var key fileHandle
+	copy(key[:handleHashSize], pathHash(path))
+	binary.BigEndian.PutUint64(key[handleHashSize:], 123)
+
+	if err := store.put(key, path); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	got, ok := store.get(key)
+	if !ok {
+		t.Fatalf("get: handle not found after put")
+	}
+	if filepath.Join(got...) != filepath.Join(path...) {
+		t.Fatalf("get returned %v, want %v", got, path)
+	}
+
+	if _, ok := store.get(fileHandle{}); ok {
+		t.Fatalf("get found a handle that was never put")
+	}
+}
+
+func TestHandleStoreDeleteByPath(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newHandleStore(dir)
+	if err != nil {
+		t.Fatalf("newHandleStore: %v", err)
+	}
+	defer func() { _ = store.db.Close() }()
+
+	path := []string{"foo", "bar"}
+	other := []string{"foo", "baz"}
+
+	for _, version := range []uint64{1, 2} {
+		var key fileHandle
+		copy(key[:handleHashSize], pathHash(path))
+		binary.BigEndian.PutUint64(key[handleHashSize:], version)
+		if err := store.put(key, path); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	var otherKey fileHandle
+	copy(otherKey[:handleHashSize], pathHash(other))
+	if err := store.put(otherKey, other); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	if err := store.deleteByPath(path); err != nil {
+		t.Fatalf("deleteByPath: %v", err)
+	}
+
+	for _, version := range []uint64{1, 2} {
+		var key fileHandle
+		copy(key[:handleHashSize], pathHash(path))
+		binary.BigEndian.PutUint64(key[handleHashSize:], version)
+		if _, ok := store.get(key); ok {
+			t.Fatalf("get found a handle (version %d) that deleteByPath should have removed", version)
+		}
+	}
+	if _, ok := store.get(otherKey); !ok {
+		t.Fatalf("deleteByPath removed a handle for an unrelated path")
+	}
+}
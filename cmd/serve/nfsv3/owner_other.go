@@ -0,0 +1,12 @@
+//go:build !unix
+
+package nfsv3
+
+import "os"
+
+// newOwnedFileInfo is a no-op on non-unix platforms: os.FileInfo.Sys()
+// has no portable uid/gid concept to overlay onto, so --nfs-uid/--nfs-gid
+// and squashing have no effect there.
+func newOwnedFileInfo(fi os.FileInfo, uid, gid uint32, uidSet, gidSet bool) os.FileInfo {
+	return fi
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package nfsv3
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedFileInfo wraps an os.FileInfo so that Sys() reports the uid/gid
+// this server is configured to present to clients - the usual place
+// NFS and FUSE libraries read file ownership from.
+type ownedFileInfo struct {
+	os.FileInfo
+	uid, gid uint32
+}
+
+func (fi ownedFileInfo) Sys() interface{} {
+	return &syscall.Stat_t{Uid: fi.uid, Gid: fi.gid}
+}
+
+// newOwnedFileInfo overlays uid/gid onto fi, passing through fi's real
+// owner for whichever of uid/gid was not resolved (uidSet/gidSet false),
+// so that setting only --nfs-uid (say) doesn't also clobber the gid
+// every client sees.
+func newOwnedFileInfo(fi os.FileInfo, uid, gid uint32, uidSet, gidSet bool) os.FileInfo {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if !uidSet {
+			uid = st.Uid
+		}
+		if !gidSet {
+			gid = st.Gid
+		}
+	}
+	return ownedFileInfo{FileInfo: fi, uid: uid, gid: gid}
+}
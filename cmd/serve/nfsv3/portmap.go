@@ -0,0 +1,96 @@
+package nfsv3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Minimal ONC RPC portmapper (RFC 1833 v2) client, just enough to
+// register/unregister this server with the local rpcbind daemon when
+// --nfs-portmap is set, so clients that discover services via portmap
+// can find the NFS server on a non-standard port.
+const (
+	pmapProgram   = 100000
+	pmapVersion   = 2
+	pmapPort      = 111
+	pmapProcSet   = 1
+	pmapProcUnset = 2
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+
+	nfsProgram = 100003
+	nfsVersion = 3
+)
+
+// pmapDialAddr is the rpcbind address pmapCall dials; a variable rather
+// than a literal so tests can point it at a fake local responder.
+var pmapDialAddr = fmt.Sprintf("127.0.0.1:%d", pmapPort)
+
+// registerPortmap registers this NFS server with the local rpcbind
+// daemon via PMAPPROC_SET.
+func registerPortmap(port int, network string) error {
+	return pmapCall(pmapProcSet, nfsProgram, nfsVersion, protoFor(network), uint32(port))
+}
+
+// unregisterPortmap reverses registerPortmap via PMAPPROC_UNSET.
+func unregisterPortmap(network string) error {
+	return pmapCall(pmapProcUnset, nfsProgram, nfsVersion, protoFor(network), 0)
+}
+
+func protoFor(network string) uint32 {
+	if network == "udp" {
+		return ipProtoUDP
+	}
+	return ipProtoTCP
+}
+
+// pmapCall makes a single ONC RPC call (RFC 1057) to the portmapper's
+// SET/UNSET procedure over UDP, the transport rpcbind listens on. It
+// is a best-effort call: deployments on the default port, or confined
+// to loopback, work fine without it.
+func pmapCall(proc, prog, vers, proto, port uint32) error {
+	conn, err := net.DialTimeout("udp", pmapDialAddr, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to reach rpcbind: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var call bytes.Buffer
+	for _, word := range []uint32{
+		1, 0, 2, // xid, mtype=CALL, rpcvers=2
+		pmapProgram, pmapVersion, proc,
+		0, 0, // cred: AUTH_NONE flavor, length 0
+		0, 0, // verf: AUTH_NONE flavor, length 0
+		prog, vers, proto, port,
+	} {
+		_ = binary.Write(&call, binary.BigEndian, word)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(call.Bytes()); err != nil {
+		return fmt.Errorf("failed to write rpcbind request: %w", err)
+	}
+
+	reply := make([]byte, 64)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return fmt.Errorf("failed to read rpcbind reply: %w", err)
+	}
+	// xid(4) mtype(4) reply_stat(4) verf flavor(4) verf length(4) accept_stat(4) result(4)
+	if n < 28 {
+		return fmt.Errorf("short rpcbind reply (%d bytes)", n)
+	}
+	if acceptStat := binary.BigEndian.Uint32(reply[20:24]); acceptStat != 0 {
+		return fmt.Errorf("rpcbind rejected the request (accept_stat=%d)", acceptStat)
+	}
+	if result := binary.BigEndian.Uint32(reply[24:28]); result == 0 {
+		return fmt.Errorf("rpcbind refused to register the mapping")
+	}
+	return nil
+}
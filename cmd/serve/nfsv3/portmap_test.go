@@ -0,0 +1,117 @@
+package nfsv3
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeRpcbind is a minimal UDP PMAPPROC_SET/UNSET responder standing in
+// for the real rpcbind daemon, just enough to exercise pmapCall's wire
+// encoding and reply decoding.
+func fakeRpcbind(t *testing.T, accept bool, gotCall chan<- []byte) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake rpcbind: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 256)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		call := make([]byte, n)
+		copy(call, buf[:n])
+		gotCall <- call
+
+		reply := make([]byte, 28)
+		binary.BigEndian.PutUint32(reply[0:4], binary.BigEndian.Uint32(call[0:4])) // echo xid
+		// mtype=REPLY(1), reply_stat=MSG_ACCEPTED(0), verf flavor/len, accept_stat=0
+		binary.BigEndian.PutUint32(reply[4:8], 1)
+		binary.BigEndian.PutUint32(reply[8:12], 0)
+		binary.BigEndian.PutUint32(reply[12:16], 0)
+		binary.BigEndian.PutUint32(reply[16:20], 0)
+		binary.BigEndian.PutUint32(reply[20:24], 0)
+		result := uint32(0)
+		if accept {
+			result = 1
+		}
+		binary.BigEndian.PutUint32(reply[24:28], result)
+		_, _ = conn.WriteTo(reply, addr)
+	}()
+	return conn
+}
+
+// dialFakeRpcbind points pmapCall at a local fake rpcbind by replacing
+// pmapDialAddr for the duration of the test.
+func dialFakeRpcbind(t *testing.T, conn net.PacketConn) {
+	t.Helper()
+	_, portStr, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to parse fake rpcbind address: %v", err)
+	}
+	if _, err := strconv.Atoi(portStr); err != nil {
+		t.Fatalf("failed to parse fake rpcbind port %q: %v", portStr, err)
+	}
+	orig := pmapDialAddr
+	pmapDialAddr = net.JoinHostPort("127.0.0.1", portStr)
+	t.Cleanup(func() { pmapDialAddr = orig })
+}
+
+func TestPmapCallAccepted(t *testing.T) {
+	gotCall := make(chan []byte, 1)
+	conn := fakeRpcbind(t, true, gotCall)
+	defer func() { _ = conn.Close() }()
+	dialFakeRpcbind(t, conn)
+
+	if err := pmapCall(pmapProcSet, nfsProgram, nfsVersion, ipProtoTCP, 2049); err != nil {
+		t.Fatalf("pmapCall: %v", err)
+	}
+
+	// Word layout written by pmapCall: xid, mtype, rpcvers,
+	// pmapProgram, pmapVersion, proc, cred flavor/length, verf
+	// flavor/length, then the PMAPPROC_SET mapping: prog, vers, proto, port.
+	select {
+	case call := <-gotCall:
+		if len(call) != 4*14 {
+			t.Fatalf("call was %d bytes, want %d", len(call), 4*14)
+		}
+		if prog := binary.BigEndian.Uint32(call[12:16]); prog != pmapProgram {
+			t.Errorf("call program = %d, want %d", prog, pmapProgram)
+		}
+		if proc := binary.BigEndian.Uint32(call[20:24]); proc != pmapProcSet {
+			t.Errorf("call proc = %d, want %d", proc, pmapProcSet)
+		}
+		if target := binary.BigEndian.Uint32(call[40:44]); target != nfsProgram {
+			t.Errorf("mapping program = %d, want %d", target, nfsProgram)
+		}
+		if port := binary.BigEndian.Uint32(call[52:56]); port != 2049 {
+			t.Errorf("mapping port = %d, want 2049", port)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("fake rpcbind never received a call")
+	}
+}
+
+func TestPmapCallRejected(t *testing.T) {
+	gotCall := make(chan []byte, 1)
+	conn := fakeRpcbind(t, false, gotCall)
+	defer func() { _ = conn.Close() }()
+	dialFakeRpcbind(t, conn)
+
+	if err := pmapCall(pmapProcSet, nfsProgram, nfsVersion, ipProtoTCP, 2049); err == nil {
+		t.Fatal("pmapCall did not return an error for a refused mapping")
+	}
+}
+
+func TestProtoFor(t *testing.T) {
+	if got := protoFor("udp"); got != ipProtoUDP {
+		t.Errorf("protoFor(%q) = %d, want %d", "udp", got, ipProtoUDP)
+	}
+	if got := protoFor("tcp4"); got != ipProtoTCP {
+		t.Errorf("protoFor(%q) = %d, want %d", "tcp4", got, ipProtoTCP)
+	}
+}